@@ -0,0 +1,33 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import (
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// getConnection dials the libvirt URI configured on the driver, falling
+// back to the default local system URI if none was set (e.g. for drivers
+// restored from an older config that predates --kvm-qemu-uri).
+func (d *Driver) getConnection() (*libvirt.Connect, error) {
+	uri := d.ConnectionURI
+	if uri == "" {
+		uri = qemusystem
+	}
+
+	return libvirt.NewConnect(uri)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const domainTmpl = `
+<domain type='kvm'>
+  <name>{{.MachineName}}</name>
+  <memory unit='MB'>{{.Memory}}</memory>
+  <vcpu>{{.CPU}}</vcpu>
+  <os>
+    <type>hvm</type>
+    <boot dev='cdrom'/>
+    <boot dev='hd'/>
+    <bootmenu enable='no'/>
+  </os>
+  <devices>
+    <disk type='file' device='cdrom'>
+      <source file='{{.ISO}}'/>
+      <target dev='hdc' bus='scsi'/>
+      <readonly/>
+    </disk>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='raw'/>
+      <source file='{{.DiskPath}}'/>
+      <target dev='hda' bus='virtio'/>
+    </disk>
+    <interface type='network'>
+      <source network='{{.Network}}'/>
+    </interface>
+    <interface type='network'>
+      <source network='{{.PrivateNetwork}}'/>
+      {{if .MAC}}<mac address='{{.MAC}}'/>{{end}}
+    </interface>
+    <serial type='pty'>
+      <target port='0'/>
+    </serial>
+    <console type='pty'>
+      <target type='serial' port='0'/>
+    </console>
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>
+    <rng model='virtio'>
+      <backend model='random'>/dev/random</backend>
+    </rng>
+    {{.GPUHostDevs}}
+  </devices>
+  {{if .Hidden}}
+  <cpu mode='host-passthrough'/>
+  <features>
+    <kvm>
+      <hidden state='on'/>
+    </kvm>
+  </features>
+  {{end}}
+</domain>
+`
+
+// domainData bundles the Driver with values computed at domain-definition
+// time (GPU hostdev XML) that aren't simple driver fields.
+type domainData struct {
+	*Driver
+	GPUHostDevs string
+}
+
+// createDomain defines (but does not start) the libvirt domain for this
+// machine, using the private-network MAC reserved in createNetwork so the
+// guest always comes up with the same static IP. When GPU passthrough was
+// requested, every host VGA/3D PCI device bound to vfio-pci is attached as
+// a hostdev; devices still bound to their native driver are not attached.
+func (d *Driver) createDomain() (*libvirt.Domain, error) {
+	conn, err := d.getConnection()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting connection")
+	}
+	defer conn.Close()
+
+	data := domainData{Driver: d}
+	if d.GPU {
+		hostdevs, err := d.gpuHostDevXML(conn)
+		if err != nil {
+			return nil, errors.Wrap(err, "attaching GPU")
+		}
+		data.GPUHostDevs = hostdevs
+	}
+
+	tmpl := template.Must(template.New("domain").Parse(domainTmpl))
+	var domainXML bytes.Buffer
+	if err := tmpl.Execute(&domainXML, data); err != nil {
+		return nil, errors.Wrap(err, "executing domain template")
+	}
+
+	dom, err := conn.DomainDefineXML(domainXML.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "defining domain %s", domainXML.String())
+	}
+
+	return dom, nil
+}
+
+// getDomain looks up the libvirt domain for this machine. The caller is
+// responsible for calling closeDomain on the returned domain and
+// connection once done with them.
+func (d *Driver) getDomain() (*libvirt.Domain, *libvirt.Connect, error) {
+	conn, err := d.getConnection()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getting connection")
+	}
+
+	dom, err := conn.LookupDomainByName(d.MachineName)
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "getting domain")
+	}
+
+	return dom, conn, nil
+}
+
+func closeDomain(dom *libvirt.Domain, conn *libvirt.Connect) {
+	if dom != nil {
+		if err := dom.Free(); err != nil {
+			log.Warnf("Failed to free domain: %v", err)
+		}
+	}
+	if conn != nil {
+		if _, err := conn.Close(); err != nil {
+			log.Warnf("Failed to close connection: %v", err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const iommuGroupsPath = "/sys/kernel/iommu_groups"
+
+// pciNodeDeviceXML is the subset of libvirt's node-device schema needed to
+// find VGA/3D controllers and check which driver they are bound to.
+type pciNodeDeviceXML struct {
+	Name   string `xml:"name,attr"`
+	Driver struct {
+		Name string `xml:"name"`
+	} `xml:"driver"`
+	Capability pciNodeDeviceCapability `xml:"capability"`
+}
+
+// pciNodeDeviceCapability is libvirt's <capability type='pci'> element.
+// domain/bus/slot/function are reported in decimal here, unlike the hex
+// libvirt expects back in a domain's <hostdev><address>.
+type pciNodeDeviceCapability struct {
+	Type   string `xml:"type,attr"`
+	Domain string `xml:"domain"`
+	Bus    string `xml:"bus"`
+	Slot   string `xml:"slot"`
+	Func   string `xml:"function"`
+	Class  string `xml:"class"`
+}
+
+// gpuCandidates returns every host PCI node device that looks like a
+// VGA/3D controller (libvirt reports these under capability class
+// 0x03xxxx), regardless of which driver it's currently bound to. On a
+// typical desktop/workstation host this includes the console adapter,
+// which is still bound to its native driver (i915, amdgpu, nvidia, ...)
+// and must not be passed through.
+func gpuCandidates(conn *libvirt.Connect) ([]pciNodeDeviceXML, error) {
+	devices, err := conn.ListAllNodeDevices(libvirt.CONNECT_LIST_NODE_DEVICES_CAP_PCI_DEV)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing node devices")
+	}
+
+	var candidates []pciNodeDeviceXML
+	for _, dev := range devices {
+		xmlDesc, err := dev.GetXMLDesc(0)
+		if err != nil {
+			continue
+		}
+		var parsed pciNodeDeviceXML
+		if err := xml.Unmarshal([]byte(xmlDesc), &parsed); err != nil {
+			continue
+		}
+		if strings.HasPrefix(parsed.Capability.Class, "0x03") {
+			candidates = append(candidates, parsed)
+		}
+	}
+
+	return candidates, nil
+}
+
+// gpuNodeDevices returns the GPU candidates that are already bound to
+// vfio-pci, i.e. the ones it's both safe and required to attach to the
+// guest as a hostdev. Candidates still bound to their native driver (e.g.
+// the console adapter) are skipped rather than failing passthrough.
+func gpuNodeDevices(conn *libvirt.Connect) ([]pciNodeDeviceXML, error) {
+	candidates, err := gpuCandidates(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var vfio []pciNodeDeviceXML
+	for _, candidate := range candidates {
+		if candidate.Driver.Name == "vfio-pci" {
+			vfio = append(vfio, candidate)
+		}
+	}
+
+	return vfio, nil
+}
+
+// gpuHostDevXML renders a <hostdev> element per vfio-pci-bound host GPU
+// for the domain XML, one per device found by gpuNodeDevices.
+func (d *Driver) gpuHostDevXML(conn *libvirt.Connect) (string, error) {
+	gpus, err := gpuNodeDevices(conn)
+	if err != nil {
+		return "", err
+	}
+	if len(gpus) == 0 {
+		return "", fmt.Errorf("kvm-gpu was requested but no host PCI device is bound to vfio-pci")
+	}
+
+	hostdevs := ""
+	for _, gpu := range gpus {
+		addr, err := gpu.Capability.hexAddress()
+		if err != nil {
+			return "", errors.Wrapf(err, "parsing PCI address of %s", gpu.Name)
+		}
+		hostdevs += fmt.Sprintf(`
+    <hostdev mode='subsystem' type='pci' managed='yes'>
+      <source>
+        <address domain='%s' bus='%s' slot='%s' function='%s'/>
+      </source>
+    </hostdev>`, addr.domain, addr.bus, addr.slot, addr.function)
+	}
+
+	return hostdevs, nil
+}
+
+// pciHostdevAddress is a PCI address formatted the way libvirt's
+// <hostdev><address> element expects it: 0x-prefixed hex.
+type pciHostdevAddress struct {
+	domain, bus, slot, function string
+}
+
+// hexAddress converts the decimal domain/bus/slot/function reported in
+// node-device XML into the 0x-prefixed hex form libvirt's <hostdev>
+// <address> element requires.
+func (c pciNodeDeviceCapability) hexAddress() (pciHostdevAddress, error) {
+	domain, err := strconv.ParseUint(c.Domain, 10, 16)
+	if err != nil {
+		return pciHostdevAddress{}, errors.Wrapf(err, "parsing domain %q", c.Domain)
+	}
+	bus, err := strconv.ParseUint(c.Bus, 10, 8)
+	if err != nil {
+		return pciHostdevAddress{}, errors.Wrapf(err, "parsing bus %q", c.Bus)
+	}
+	slot, err := strconv.ParseUint(c.Slot, 10, 8)
+	if err != nil {
+		return pciHostdevAddress{}, errors.Wrapf(err, "parsing slot %q", c.Slot)
+	}
+	function, err := strconv.ParseUint(c.Func, 10, 8)
+	if err != nil {
+		return pciHostdevAddress{}, errors.Wrapf(err, "parsing function %q", c.Func)
+	}
+
+	return pciHostdevAddress{
+		domain:   fmt.Sprintf("0x%04x", domain),
+		bus:      fmt.Sprintf("0x%02x", bus),
+		slot:     fmt.Sprintf("0x%02x", slot),
+		function: fmt.Sprintf("0x%x", function),
+	}, nil
+}
+
+// checkGPUPassthrough verifies the host is actually ready for
+// --kvm-gpu: IOMMU must be enabled by the kernel, and at least one
+// candidate GPU must already be bound to vfio-pci. Candidates still
+// bound to their native driver (commonly the console adapter) are
+// reported in the error but don't fail the check on their own — only
+// the device(s) the caller wants passed through need to be rebound.
+func (d *Driver) checkGPUPassthrough(conn *libvirt.Connect) error {
+	if _, err := os.Stat(iommuGroupsPath); err != nil {
+		return fmt.Errorf("IOMMU does not appear to be enabled (missing %s): add intel_iommu=on or amd_iommu=on to the kernel command line and reboot", iommuGroupsPath)
+	}
+
+	candidates, err := gpuCandidates(conn)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no host VGA/3D PCI devices were found for passthrough")
+	}
+
+	var vfioBound int
+	bindings := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		bindings = append(bindings, fmt.Sprintf("%s (bound to %s)", candidate.Name, candidate.Driver.Name))
+		if candidate.Driver.Name == "vfio-pci" {
+			vfioBound++
+		}
+	}
+	if vfioBound == 0 {
+		return fmt.Errorf("found host VGA/3D devices but none are bound to vfio-pci: %s; unbind the device(s) you want to pass through from their native driver and bind them to vfio-pci", strings.Join(bindings, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import "testing"
+
+func TestHexAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		cap     pciNodeDeviceCapability
+		want    pciHostdevAddress
+		wantErr bool
+	}{
+		{
+			name: "single digit values",
+			cap:  pciNodeDeviceCapability{Domain: "0", Bus: "0", Slot: "5", Func: "0"},
+			want: pciHostdevAddress{domain: "0x0000", bus: "0x00", slot: "0x05", function: "0x0"},
+		},
+		{
+			name: "double digit bus and slot",
+			cap:  pciNodeDeviceCapability{Domain: "0", Bus: "16", Slot: "31", Func: "1"},
+			want: pciHostdevAddress{domain: "0x0000", bus: "0x10", slot: "0x1f", function: "0x1"},
+		},
+		{
+			name:    "non-numeric bus",
+			cap:     pciNodeDeviceCapability{Domain: "0", Bus: "ff", Slot: "0", Func: "0"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cap.hexAddress()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("hexAddress() returned no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("hexAddress() returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("hexAddress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
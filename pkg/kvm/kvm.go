@@ -32,11 +32,10 @@ import (
 )
 
 const (
-	qemusystem                = "qemu:///system"
-	defaultPrivateNetworkName = "minikube-net"
-	defaultNetworkName        = "default"
-	defaultSSHUser            = "docker"
-	isoFilename               = "boot2docker.iso"
+	qemusystem         = "qemu:///system"
+	defaultNetworkName = "default"
+	defaultSSHUser     = "docker"
+	isoFilename        = "boot2docker.iso"
 )
 
 type Driver struct {
@@ -55,6 +54,13 @@ type Driver struct {
 	// The name of the private network
 	PrivateNetwork string
 
+	// The CIDR of the private network, e.g. 192.168.39.0/24
+	PrivateNetworkCIDR string
+
+	// A static IP to reserve for this machine on the private network,
+	// pinned to its MAC so it survives VM restarts
+	StaticIP string
+
 	// The size of the disk to be created for the VM, in MB
 	DiskSize int
 
@@ -70,6 +76,22 @@ type Driver struct {
 	// The randomly generated MAC Address
 	// If empty, a random MAC will be generated.
 	MAC string
+
+	// The libvirt connection URI to dial, e.g. qemu:///system,
+	// qemu:///session or qemu+ssh://host/system
+	ConnectionURI string
+
+	// Passthrough all vfio-pci-bound host VGA/3D PCI devices to the guest
+	GPU bool
+
+	// Hide the KVM signature from the guest and enable host-passthrough
+	// CPU mode, so guest drivers (notably NVIDIA) don't refuse to load
+	// inside a KVM guest
+	Hidden bool
+
+	// How long, in seconds, to wait for a graceful shutdown before
+	// forcing the VM off
+	ShutdownTimeout int
 }
 
 func NewDriver(hostName, storePath string) *Driver {
@@ -127,6 +149,40 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "SSH username",
 			Value:  defaultSSHUser,
 		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_QEMU_URI",
+			Name:   "kvm-qemu-uri",
+			Usage:  "The libvirt URI to connect to, e.g. qemu:///session or qemu+ssh://host/system",
+			Value:  qemusystem,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-private-network-name",
+			Usage: "Name of the dedicated private network to create for this machine. Defaults to a per-machine network so it doesn't collide with the shared default/minikube-net; pass the same name across machines to let them share one",
+			Value: "",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-private-network-cidr",
+			Usage: "The CIDR to be used for the dedicated private network",
+			Value: defaultPrivateNetworkCIDR,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-static-ip",
+			Usage: "A static IP to reserve for this machine on the private network (must fall within kvm-private-network-cidr)",
+			Value: "",
+		},
+		mcnflag.BoolFlag{
+			Name:  "kvm-gpu",
+			Usage: "Passthrough all host VGA/3D PCI devices bound to vfio-pci to the guest (requires IOMMU)",
+		},
+		mcnflag.BoolFlag{
+			Name:  "kvm-hidden",
+			Usage: "Hide the KVM hypervisor signature from the guest, for use with NVIDIA GPU drivers",
+		},
+		mcnflag.IntFlag{
+			Name:  "kvm-shutdown-timeout",
+			Usage: "How long in seconds to wait for a graceful ACPI/guest-agent shutdown before forcing the VM off",
+			Value: defaultShutdownTimeout,
+		},
 	}
 }
 
@@ -136,7 +192,17 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.DiskSize = flags.Int("kvm-disk-size")
 	d.CPU = flags.Int("kvm-cpu-count")
 	d.Network = flags.String("kvm-network")
+	d.PrivateNetwork = flags.String("kvm-private-network-name")
+	if d.PrivateNetwork == "" {
+		d.PrivateNetwork = fmt.Sprintf("%s-net", d.MachineName)
+	}
+	d.PrivateNetworkCIDR = flags.String("kvm-private-network-cidr")
+	d.StaticIP = flags.String("kvm-static-ip")
 	d.Boot2DockerURL = flags.String("kvm-boot2docker-url")
+	d.ConnectionURI = flags.String("kvm-qemu-uri")
+	d.GPU = flags.Bool("kvm-gpu")
+	d.Hidden = flags.Bool("kvm-hidden")
+	d.ShutdownTimeout = flags.Int("kvm-shutdown-timeout")
 	d.ISO = d.ResolveStorePath(isoFilename)
 	d.SSHUser = flags.String("kvm-ssh-user")
 	d.SSHPort = 22
@@ -145,7 +211,7 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 }
 
 func (d *Driver) PreCommandCheck() error {
-	conn, err := getConnection()
+	conn, err := d.getConnection()
 	if err != nil {
 		return errors.Wrap(err, "Error connecting to libvirt socket.  Have you added yourself to the libvirtd group?")
 	}
@@ -153,7 +219,13 @@ func (d *Driver) PreCommandCheck() error {
 	if err != nil {
 		return errors.Wrap(err, "getting libvirt version")
 	}
-	log.Debugf("Using libvirt version %d", libVersion)
+	log.Infof("Using libvirt version %d, driver version %s (commit %s)", libVersion, version, gitCommitID)
+
+	if d.GPU {
+		if err := d.checkGPUPassthrough(conn); err != nil {
+			return errors.Wrap(err, "checking GPU passthrough prerequisites")
+		}
+	}
 
 	return nil
 }
@@ -367,45 +439,9 @@ func (d *Driver) Create() error {
 	return d.Start()
 }
 
-func (d *Driver) Stop() error {
-	d.IPAddress = ""
-	s, err := d.GetState()
-	if err != nil {
-		return errors.Wrap(err, "getting state of VM")
-	}
-
-	if s != state.Stopped {
-		dom, conn, err := d.getDomain()
-		defer closeDomain(dom, conn)
-		if err != nil {
-			return errors.Wrap(err, "getting connection")
-		}
-
-		err = dom.Shutdown()
-		if err != nil {
-			return errors.Wrap(err, "stopping vm")
-		}
-
-		for i := 0; i < 60; i++ {
-			s, err := d.GetState()
-			if err != nil {
-				return errors.Wrap(err, "Error getting state of VM")
-			}
-			if s == state.Stopped {
-				return nil
-			}
-			log.Infof("Waiting for machine to stop %d/%d", i, 60)
-			time.Sleep(1 * time.Second)
-		}
-
-	}
-
-	return fmt.Errorf("Could not stop VM, current state %s", s.String())
-}
-
 func (d *Driver) Remove() error {
 	log.Debug("Removing machine...")
-	conn, err := getConnection()
+	conn, err := d.getConnection()
 	if err != nil {
 		return errors.Wrap(err, "getting connection")
 	}
@@ -418,9 +454,17 @@ func (d *Driver) Remove() error {
 		log.Warn("Network %s does not exist, nothing to clean up...", d.PrivateNetwork)
 	}
 	if network != nil {
-		log.Infof("Network %s exists, removing...", d.PrivateNetwork)
-		network.Destroy()
-		network.Undefine()
+		inUse, err := networkInUseByOtherDomain(conn, d.PrivateNetwork, d.MachineName)
+		if err != nil {
+			return errors.Wrap(err, "checking network usage")
+		}
+		if inUse {
+			log.Infof("Network %s is still in use by another domain, leaving it in place", d.PrivateNetwork)
+		} else {
+			log.Infof("Network %s exists, removing...", d.PrivateNetwork)
+			network.Destroy()
+			network.Undefine()
+		}
 	}
 
 	log.Debug("Checking if the domain needs to be deleted")
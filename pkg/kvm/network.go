@@ -0,0 +1,343 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"text/template"
+
+	"github.com/docker/machine/libmachine/log"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const defaultPrivateNetworkCIDR = "192.168.39.0/24"
+
+const privateNetworkTmpl = `
+<network>
+  <name>{{.Name}}</name>
+  <dns enable='no'/>
+  <ip address='{{.GatewayIP}}' netmask='{{.Netmask}}'>
+    <dhcp>
+      <range start='{{.RangeStart}}' end='{{.RangeEnd}}'/>
+      {{if .HostMAC}}<host mac='{{.HostMAC}}' ip='{{.HostIP}}'/>{{end}}
+    </dhcp>
+  </ip>
+</network>
+`
+
+// networkXML is the subset of libvirt's network schema we need to inspect
+// existing networks for static IP collisions.
+type networkXML struct {
+	IP struct {
+		DHCP struct {
+			Hosts []struct {
+				MAC string `xml:"mac,attr"`
+				IP  string `xml:"ip,attr"`
+			} `xml:"host"`
+		} `xml:"dhcp"`
+	} `xml:"ip"`
+}
+
+// domainXMLNetworks is the subset of a domain's XML needed to tell which
+// networks it still has interfaces on.
+type domainXMLNetworks struct {
+	Devices struct {
+		Interfaces []struct {
+			Source struct {
+				Network string `xml:"network,attr"`
+			} `xml:"source"`
+		} `xml:"interface"`
+	} `xml:"devices"`
+}
+
+// networkIPXML is the subset of libvirt's network schema needed to derive
+// the live CIDR of an already-defined network.
+type networkIPXML struct {
+	IP struct {
+		Address string `xml:"address,attr"`
+		Netmask string `xml:"netmask,attr"`
+	} `xml:"ip"`
+}
+
+// existingNetworkCIDR reads the <ip address=.. netmask=..> of an
+// already-defined network and returns it as a CIDR string, so a static IP
+// can be validated against the subnet the network actually serves instead
+// of a --kvm-private-network-cidr that may no longer match it.
+func existingNetworkCIDR(network *libvirt.Network) (string, error) {
+	xmlDesc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return "", errors.Wrap(err, "getting network XML")
+	}
+	var parsed networkIPXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &parsed); err != nil {
+		return "", errors.Wrap(err, "parsing network XML")
+	}
+
+	ip := net.ParseIP(parsed.IP.Address).To4()
+	mask := net.ParseIP(parsed.IP.Netmask).To4()
+	if ip == nil || mask == nil {
+		return "", fmt.Errorf("network has no usable IPv4 <ip address>/<netmask>")
+	}
+
+	ipnet := net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+	return ipnet.String(), nil
+}
+
+// createNetwork ensures the private network for this machine exists,
+// defining it with a static DHCP reservation for the VM's MAC when a
+// static IP was requested so GetIP() returns a deterministic address
+// across restarts. If the network already exists (e.g. it was created by
+// an earlier machine sharing it), the reservation is added to it rather
+// than silently dropped.
+func (d *Driver) createNetwork() error {
+	if d.PrivateNetwork == "" {
+		return nil
+	}
+
+	conn, err := d.getConnection()
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
+	}
+	defer conn.Close()
+
+	existing, lookupErr := conn.LookupNetworkByName(d.PrivateNetwork)
+
+	cidr := d.PrivateNetworkCIDR
+	if cidr == "" {
+		cidr = defaultPrivateNetworkCIDR
+	}
+	if lookupErr == nil {
+		// Validate against the subnet the network actually serves, not a
+		// --kvm-private-network-cidr that may no longer match it.
+		actualCIDR, err := existingNetworkCIDR(existing)
+		if err != nil {
+			return errors.Wrapf(err, "reading CIDR of existing network %s", d.PrivateNetwork)
+		}
+		cidr = actualCIDR
+	}
+
+	if d.StaticIP != "" {
+		if err := d.validateStaticIP(conn, cidr); err != nil {
+			return err
+		}
+		if d.MAC == "" {
+			mac, err := generateMAC()
+			if err != nil {
+				return errors.Wrap(err, "generating MAC address")
+			}
+			d.MAC = mac
+		}
+	}
+
+	if lookupErr == nil {
+		log.Debugf("Network %s already exists, skipping creation", d.PrivateNetwork)
+		if d.StaticIP == "" {
+			return nil
+		}
+		if err := addDHCPHostReservation(existing, d.MAC, d.StaticIP); err != nil {
+			return errors.Wrapf(err, "reserving %s on existing network %s", d.StaticIP, d.PrivateNetwork)
+		}
+		return nil
+	}
+
+	gatewayIP, netmask, rangeStart, rangeEnd, err := splitNetworkCIDR(cidr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", cidr)
+	}
+
+	tmpl := template.Must(template.New("network").Parse(privateNetworkTmpl))
+	var networkXMLBuf bytes.Buffer
+	if err := tmpl.Execute(&networkXMLBuf, struct {
+		Name       string
+		GatewayIP  string
+		Netmask    string
+		RangeStart string
+		RangeEnd   string
+		HostMAC    string
+		HostIP     string
+	}{
+		Name:       d.PrivateNetwork,
+		GatewayIP:  gatewayIP,
+		Netmask:    netmask,
+		RangeStart: rangeStart,
+		RangeEnd:   rangeEnd,
+		HostMAC:    d.MAC,
+		HostIP:     d.StaticIP,
+	}); err != nil {
+		return errors.Wrap(err, "executing network template")
+	}
+
+	network, err := conn.NetworkDefineXML(networkXMLBuf.String())
+	if err != nil {
+		return errors.Wrapf(err, "defining network %s", networkXMLBuf.String())
+	}
+	if err := network.SetAutostart(true); err != nil {
+		return errors.Wrap(err, "setting network to autostart")
+	}
+	if err := network.Create(); err != nil {
+		return errors.Wrap(err, "creating network")
+	}
+
+	return nil
+}
+
+// validateStaticIP checks that d.StaticIP falls within cidr and that no
+// libvirt network (including the target one) already reserves it, so two
+// machines never race for the same lease.
+func (d *Driver) validateStaticIP(conn *libvirt.Connect, cidr string) error {
+	ip := net.ParseIP(d.StaticIP)
+	if ip == nil {
+		return fmt.Errorf("%s is not a valid IP address", d.StaticIP)
+	}
+
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", cidr)
+	}
+	if !ipnet.Contains(ip) {
+		return fmt.Errorf("static IP %s is not within the private network CIDR %s", d.StaticIP, cidr)
+	}
+
+	networks, err := conn.ListAllNetworks(libvirt.CONNECT_LIST_NETWORKS_ACTIVE | libvirt.CONNECT_LIST_NETWORKS_INACTIVE)
+	if err != nil {
+		return errors.Wrap(err, "listing networks")
+	}
+	for _, n := range networks {
+		xmlDesc, err := n.GetXMLDesc(0)
+		if err != nil {
+			continue
+		}
+		var parsed networkXML
+		if err := xml.Unmarshal([]byte(xmlDesc), &parsed); err != nil {
+			continue
+		}
+		for _, host := range parsed.IP.DHCP.Hosts {
+			if host.IP == d.StaticIP {
+				return fmt.Errorf("static IP %s is already reserved on network %s", d.StaticIP, nameOf(n))
+			}
+		}
+	}
+
+	return nil
+}
+
+// addDHCPHostReservation adds a live+persistent DHCP host entry to an
+// already-defined network, for the case where the private network is
+// shared across machines and already exists by the time this one needs
+// its static IP reserved.
+func addDHCPHostReservation(network *libvirt.Network, mac, ip string) error {
+	hostXML := fmt.Sprintf("<host mac='%s' ip='%s'/>", mac, ip)
+	return network.Update(
+		libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST,
+		libvirt.NETWORK_SECTION_IP_DHCP_HOST,
+		-1,
+		hostXML,
+		libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG,
+	)
+}
+
+func nameOf(n libvirt.Network) string {
+	name, err := n.GetName()
+	if err != nil {
+		return "<unknown>"
+	}
+	return name
+}
+
+// splitNetworkCIDR derives the gateway IP (first usable address), netmask,
+// and DHCP range (the remaining usable addresses up to the broadcast
+// address) for a private network CIDR of any prefix length, not just /24.
+func splitNetworkCIDR(cidr string) (gatewayIP, netmask, rangeStart, rangeEnd string, err error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	ip4 := ip.To4()
+	mask4 := net.IP(ipnet.Mask).To4()
+	if ip4 == nil || mask4 == nil {
+		return "", "", "", "", fmt.Errorf("%s is not an IPv4 CIDR", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return "", "", "", "", fmt.Errorf("%s must be an IPv4 CIDR of /30 or larger to fit a gateway and a DHCP range", cidr)
+	}
+
+	network := binary.BigEndian.Uint32(ip4.Mask(ipnet.Mask))
+	maskBits := binary.BigEndian.Uint32(mask4)
+	broadcast := network | ^maskBits
+
+	gateway := uint32ToIPv4(network + 1)
+	start := uint32ToIPv4(network + 2)
+	end := uint32ToIPv4(broadcast - 1)
+
+	return gateway.String(), net.IP(ipnet.Mask).String(), start.String(), end.String(), nil
+}
+
+func uint32ToIPv4(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// generateMAC returns a locally-administered, unicast MAC address suitable
+// for a libvirt network's DHCP host reservation.
+func generateMAC() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[0] = (buf[0] | 0x02) & 0xfe
+
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5]), nil
+}
+
+// networkInUseByOtherDomain reports whether any domain other than
+// excludeDomain still has an interface attached to network.
+func networkInUseByOtherDomain(conn *libvirt.Connect, network, excludeDomain string) (bool, error) {
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return false, errors.Wrap(err, "listing domains")
+	}
+
+	for _, dom := range domains {
+		name, err := dom.GetName()
+		if err != nil || name == excludeDomain {
+			continue
+		}
+		xmlDesc, err := dom.GetXMLDesc(0)
+		if err != nil {
+			continue
+		}
+		var parsed domainXMLNetworks
+		if err := xml.Unmarshal([]byte(xmlDesc), &parsed); err != nil {
+			continue
+		}
+		for _, iface := range parsed.Devices.Interfaces {
+			if iface.Source.Network == network {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
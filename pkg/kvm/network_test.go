@@ -0,0 +1,81 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import "testing"
+
+func TestSplitNetworkCIDR(t *testing.T) {
+	tests := []struct {
+		cidr       string
+		gatewayIP  string
+		netmask    string
+		rangeStart string
+		rangeEnd   string
+	}{
+		{
+			cidr:       "192.168.39.0/24",
+			gatewayIP:  "192.168.39.1",
+			netmask:    "255.255.255.0",
+			rangeStart: "192.168.39.2",
+			rangeEnd:   "192.168.39.254",
+		},
+		{
+			cidr:       "10.0.5.0/26",
+			gatewayIP:  "10.0.5.1",
+			netmask:    "255.255.255.192",
+			rangeStart: "10.0.5.2",
+			rangeEnd:   "10.0.5.62",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			gatewayIP, netmask, rangeStart, rangeEnd, err := splitNetworkCIDR(tt.cidr)
+			if err != nil {
+				t.Fatalf("splitNetworkCIDR(%q) returned error: %v", tt.cidr, err)
+			}
+			if gatewayIP != tt.gatewayIP {
+				t.Errorf("gatewayIP = %q, want %q", gatewayIP, tt.gatewayIP)
+			}
+			if netmask != tt.netmask {
+				t.Errorf("netmask = %q, want %q", netmask, tt.netmask)
+			}
+			if rangeStart != tt.rangeStart {
+				t.Errorf("rangeStart = %q, want %q", rangeStart, tt.rangeStart)
+			}
+			if rangeEnd != tt.rangeEnd {
+				t.Errorf("rangeEnd = %q, want %q", rangeEnd, tt.rangeEnd)
+			}
+		})
+	}
+}
+
+func TestSplitNetworkCIDRErrors(t *testing.T) {
+	tests := []string{
+		"not-a-cidr",
+		"192.168.39.0/31",
+		"2001:db8::/64",
+	}
+
+	for _, cidr := range tests {
+		t.Run(cidr, func(t *testing.T) {
+			if _, _, _, _, err := splitNetworkCIDR(cidr); err == nil {
+				t.Errorf("splitNetworkCIDR(%q) returned no error, want one", cidr)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/pkg/errors"
+)
+
+const defaultShutdownTimeout = 120
+
+// init registers libvirt's default event loop implementation before this
+// package ever opens a connection. Libvirt requires EventRegisterDefaultImpl
+// to run before the first libvirt.NewConnect call for lifecycle callbacks
+// (like the one Stop uses to wake on VIR_DOMAIN_EVENT_STOPPED) to fire at
+// all; registering it lazily inside Stop, after getConnection has already
+// been called elsewhere, silently degrades to 1s polling.
+func init() {
+	if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+		log.Warnf("Could not register libvirt event loop, Stop will fall back to polling: %v", err)
+		return
+	}
+	go func() {
+		for {
+			if err := libvirt.EventRunDefaultImpl(); err != nil {
+				log.Debugf("libvirt event loop iteration failed: %v", err)
+			}
+		}
+	}()
+}
+
+// Stop requests a graceful shutdown of the VM. It first asks the guest to
+// power off via its ACPI button, falls back to the qemu-guest-agent if the
+// guest is still up after --kvm-shutdown-timeout seconds, and as a last
+// resort forces the VM off with Destroy rather than leaving minikube stop
+// hanging on an unresponsive guest.
+func (d *Driver) Stop() error {
+	d.IPAddress = ""
+	s, err := d.GetState()
+	if err != nil {
+		return errors.Wrap(err, "getting state of VM")
+	}
+	if s == state.Stopped {
+		return nil
+	}
+
+	dom, conn, err := d.getDomain()
+	if err != nil {
+		return errors.Wrap(err, "getting connection")
+	}
+	defer closeDomain(dom, conn)
+
+	timeout := time.Duration(d.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout * time.Second
+	}
+
+	stopped := make(chan struct{}, 1)
+	callbackID, err := conn.DomainEventLifecycleRegister(dom, func(c *libvirt.Connect, domEvent *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		if event.Event == libvirt.DOMAIN_EVENT_STOPPED {
+			select {
+			case stopped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		log.Warnf("Could not register domain lifecycle event callback, falling back to polling: %v", err)
+	} else {
+		defer conn.DomainEventDeregister(callbackID)
+	}
+
+	log.Info("Sending ACPI power button shutdown request...")
+	if err := dom.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN); err != nil {
+		log.Warnf("ACPI shutdown request failed, will keep waiting: %v", err)
+	}
+
+	if d.waitForShutoff(dom, stopped, timeout) {
+		return nil
+	}
+
+	if hasGuestAgentChannel(dom) {
+		log.Infof("VM still running after %s, retrying shutdown via the qemu-guest-agent...", timeout)
+		if err := dom.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT); err != nil {
+			log.Warnf("Guest agent shutdown request failed: %v", err)
+		} else if d.waitForShutoff(dom, stopped, timeout) {
+			return nil
+		}
+	}
+
+	log.Warnf("VM did not shut down gracefully within the timeout, forcing it off")
+	if err := dom.Destroy(); err != nil {
+		return errors.Wrap(err, "destroying VM after graceful shutdown failed")
+	}
+
+	return nil
+}
+
+// waitForShutoff blocks until either the lifecycle event callback reports
+// VIR_DOMAIN_EVENT_STOPPED or timeout elapses, polling the domain state
+// once a second as a backstop in case the event was missed.
+func (d *Driver) waitForShutoff(dom *libvirt.Domain, stopped chan struct{}, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-stopped:
+			return true
+		case <-time.After(time.Second):
+			libvirtState, _, err := dom.GetState()
+			if err == nil && libvirtState == libvirt.DOMAIN_SHUTOFF {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasGuestAgentChannel reports whether the domain has a
+// org.qemu.guest_agent.0 virtio-serial channel defined, which is required
+// for VIR_DOMAIN_SHUTDOWN_GUEST_AGENT to have any effect.
+func hasGuestAgentChannel(dom *libvirt.Domain) bool {
+	xmlDesc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		log.Warnf("Could not inspect domain XML for a guest agent channel: %v", err)
+		return false
+	}
+
+	return strings.Contains(xmlDesc, "org.qemu.guest_agent.0")
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvm
+
+// version and gitCommitID are set at build time via:
+//   go build -ldflags "-X github.com/praveenkumar/machine-kvm2-driver/pkg/kvm.version=... \
+//                       -X github.com/praveenkumar/machine-kvm2-driver/pkg/kvm.gitCommitID=..."
+// They default to "unknown" for local/dev builds that don't pass -ldflags.
+var (
+	version     = "unknown"
+	gitCommitID = "unknown"
+)
+
+// Version returns the driver version this binary was built with.
+func Version() string {
+	return version
+}
+
+// GitCommitID returns the git commit this binary was built from.
+func GitCommitID() string {
+	return gitCommitID
+}